@@ -0,0 +1,277 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sendPacketContext prepares an SNMPv3 packet's security parameters,
+// discovering the authoritative engine on first use, then hands off to
+// transact. v1/v2c packets skip straight to transact.
+func (x *Conn) sendPacketContext(ctx context.Context, packet *SnmpPacket) (*SnmpPacket, error) {
+	if x.Version == Version3 && x.usm != nil {
+		x.usm.mu.Lock()
+		discovered := x.usm.discovered
+		x.usm.mu.Unlock()
+		if !discovered {
+			if err := x.discoverEngine(); err != nil {
+				return nil, err
+			}
+		}
+		packet.SecurityParameters = x.usm
+	}
+
+	return x.transact(ctx, packet)
+}
+
+// transact registers a waiter for the packet's RequestID, writes it, and
+// blocks on that waiter, ctx.Done(), or a fixed per-attempt deadline of
+// Conn.Timeout, whichever comes first. UDP datagram loss is the common
+// failure mode for SNMP polling, so a bare timeout is retried up to
+// Conn.Retries times, with an exponential backoff (base Conn.Timeout,
+// capped at Conn.MaxBackoff) slept between attempts, before the caller
+// sees an error.
+func (x *Conn) transact(ctx context.Context, packet *SnmpPacket) (*SnmpPacket, error) {
+	backoff := x.Timeout
+
+	for attempt := 0; ; attempt++ {
+		packet.RequestID = x.nextRequestID()
+		waiter := x.register(packet.RequestID)
+
+		fBuf, err := packet.marshal()
+		if err != nil {
+			x.deregister(packet.RequestID)
+			return nil, err
+		}
+
+		if packet.SecurityParameters != nil {
+			fBuf, err = packet.SecurityParameters.wrap(fBuf)
+			if err != nil {
+				x.deregister(packet.RequestID)
+				return nil, err
+			}
+		}
+
+		x.conn.SetWriteDeadline(time.Now().Add(x.Timeout))
+		if _, err = x.conn.Write(fBuf); err != nil {
+			x.deregister(packet.RequestID)
+			return nil, fmt.Errorf("Error writing to socket: %s\n", err.Error())
+		}
+
+		select {
+		case pdu, ok := <-waiter:
+			if !ok {
+				return nil, fmt.Errorf("Error reading from UDP: connection closed\n")
+			}
+			if len(pdu.Variables) < 1 {
+				return nil, fmt.Errorf("No responses received.")
+			}
+			return pdu, nil
+
+		case <-ctx.Done():
+			x.deregister(packet.RequestID)
+			return nil, ctx.Err()
+
+		case <-time.After(x.Timeout):
+			x.deregister(packet.RequestID)
+			if attempt >= x.Retries {
+				return nil, fmt.Errorf("Error reading from UDP: timed out waiting for a response after %d attempts\n", attempt+1)
+			}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > x.MaxBackoff {
+			backoff = x.MaxBackoff
+		}
+	}
+}
+
+// GetContext is the context-aware form of Get.
+func (x *Conn) GetContext(ctx context.Context, oid string) (resp *SnmpPacket, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	packet := new(SnmpPacket)
+	packet.Community = x.Community
+	packet.Error = 0
+	packet.ErrorIndex = 0
+	packet.RequestType = GetRequest
+	packet.Version = x.Version
+	packet.Variables = []SnmpPDU{SnmpPDU{Name: oid, Type: Null}}
+
+	resp, err = x.sendPacketContext(ctx, packet)
+	return
+}
+
+// GetNextContext is the context-aware form of GetNext.
+func (x *Conn) GetNextContext(ctx context.Context, oid string) (resp *SnmpPacket, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	packet := new(SnmpPacket)
+	packet.Community = x.Community
+	packet.Error = 0
+	packet.ErrorIndex = 0
+	packet.RequestType = GetNextRequest
+	packet.Version = x.Version
+	packet.Variables = []SnmpPDU{SnmpPDU{Name: oid, Type: Null}}
+
+	resp, err = x.sendPacketContext(ctx, packet)
+	return
+}
+
+// GetBulkContext is the context-aware form of GetBulk.
+func (x *Conn) GetBulkContext(ctx context.Context, nonRepeaters, maxRepetitions uint8, oids ...string) (resp *SnmpPacket, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	packet := new(SnmpPacket)
+	packet.Community = x.Community
+	packet.NonRepeaters = nonRepeaters
+	packet.MaxRepetitions = maxRepetitions
+	packet.RequestType = GetBulkRequest
+	packet.Version = x.Version
+	packet.Variables = make([]SnmpPDU, len(oids))
+
+	for i, oid := range oids {
+		packet.Variables[i] = SnmpPDU{Name: oid, Type: Null}
+	}
+
+	resp, err = x.sendPacketContext(ctx, packet)
+	return
+}
+
+// GetMultiContext is the context-aware form of GetMulti.
+func (x *Conn) GetMultiContext(ctx context.Context, oids []string) (resp *SnmpPacket, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	packet := new(SnmpPacket)
+	packet.Community = x.Community
+	packet.Error = 0
+	packet.ErrorIndex = 0
+	packet.RequestType = GetRequest
+	packet.Version = x.Version
+	packet.Variables = make([]SnmpPDU, len(oids))
+
+	for i, oid := range oids {
+		packet.Variables[i] = SnmpPDU{Name: oid, Type: Null}
+	}
+
+	resp, err = x.sendPacketContext(ctx, packet)
+	return
+}
+
+// WalkContext is the context-aware form of Walk.
+func (x *Conn) WalkContext(ctx context.Context, oid string) (results []SnmpPDU, err error) {
+	if oid == "" {
+		return nil, fmt.Errorf("No OID given\n")
+	}
+	results = make([]SnmpPDU, 0)
+	requestOid := oid
+
+	for {
+		res, err := x.GetNextContext(ctx, oid)
+		if err != nil {
+			return results, err
+		}
+		if res == nil || len(res.Variables) == 0 {
+			break
+		}
+		if strings.Index(res.Variables[0].Name, requestOid) <= -1 {
+			x.Log.Debug("Root OID mismatch, stopping walk\n")
+			break
+		}
+		results = append(results, res.Variables[0])
+		oid = res.Variables[0].Name
+		x.Log.Debug("Moving to %s\n", oid)
+	}
+	return
+}
+
+// BulkWalkContext is the context-aware form of BulkWalk.
+func (x *Conn) BulkWalkContext(ctx context.Context, maxRepetitions uint8, oid string) (results []SnmpPDU, err error) {
+	if oid == "" {
+		return nil, fmt.Errorf("No OID given\n")
+	}
+	return x._bulkWalkContext(ctx, maxRepetitions, oid, oid)
+}
+
+func (x *Conn) _bulkWalkContext(ctx context.Context, maxRepetitions uint8, searchingOID string, rootOID string) (results []SnmpPDU, err error) {
+	response, err := x.GetBulkContext(ctx, 0, maxRepetitions, searchingOID)
+	if err != nil {
+		return
+	}
+	for i, v := range response.Variables {
+		if v.Value == "endOfMib" {
+			return
+		}
+		if strings.HasPrefix(v.Name, rootOID) {
+			results = append(results, v)
+			if i == len(response.Variables)-1 {
+				var subResults []SnmpPDU
+				subResults, err = x._bulkWalkContext(ctx, maxRepetitions, v.Name, rootOID)
+				if err != nil {
+					return
+				}
+				results = append(results, subResults...)
+			}
+		}
+	}
+	return
+}
+
+// StreamBulkWalkContext is the context-aware form of StreamBulkWalk.
+func (x *Conn) StreamBulkWalkContext(ctx context.Context, maxRepetitions uint8, oid string, resultChan chan *SnmpPDU) error {
+	rootOID := oid
+	response, err := x.GetBulkContext(ctx, 0, maxRepetitions, oid)
+	if err != nil {
+		close(resultChan)
+		return err
+	}
+	for i, v := range response.Variables {
+		if v.Value == "endOfMib" {
+			close(resultChan)
+			return nil
+		}
+		if strings.HasPrefix(v.Name, rootOID) {
+			resultChan <- &v
+			if i == len(response.Variables)-1 {
+				var subResults []SnmpPDU
+				subResults, err = x._bulkWalkContext(ctx, maxRepetitions, v.Name, rootOID)
+				if err != nil {
+					close(resultChan)
+					return err
+				}
+				for _, subResult := range subResults {
+					resultChan <- &subResult
+				}
+			}
+		}
+	}
+	close(resultChan)
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"sync/atomic"
+)
+
+// startReader launches the single goroutine that owns x.conn's reads. All
+// of Get/GetNext/GetBulk/GetMulti/Set register a waiter keyed by
+// RequestID before writing their packet, so many goroutines can safely
+// share one Conn; readLoop dispatches each decoded reply to the waiter
+// that's expecting it.
+func (x *Conn) startReader() {
+	x.waiters = make(map[int32]chan *SnmpPacket)
+	go x.readLoop()
+}
+
+// readLoop decodes incoming datagrams and routes them to the waiter
+// registered for their RequestID, discarding replies nobody is waiting
+// for (e.g. a retry's original attempt finally landing late).
+func (x *Conn) readLoop() {
+	for {
+		// A fresh buffer every read: resp[:n] is handed off to whichever
+		// goroutine is waiting for this RequestID, which may still be
+		// reading it after the next datagram arrives.
+		resp := make([]byte, 8192, 8192)
+		n, err := x.conn.Read(resp)
+		if err != nil {
+			x.failAllWaiters(err)
+			return
+		}
+
+		data := resp[:n]
+		if x.usm != nil {
+			x.usm.mu.Lock()
+			needsUnwrap := x.usm.discovered && x.usm.SecurityLevel != NoAuthNoPriv
+			x.usm.mu.Unlock()
+			if needsUnwrap {
+				data, err = x.usm.unwrap(data)
+				if err != nil {
+					x.Log.Debug("Discarding datagram that failed SNMPv3 authentication: %s\n", err.Error())
+					continue
+				}
+			}
+		}
+
+		pdu, err := Unmarshal(data)
+		if err != nil {
+			x.Log.Debug("Discarding unparseable datagram: %s\n", err.Error())
+			continue
+		}
+
+		x.mu.Lock()
+		ch, ok := x.waiters[pdu.RequestID]
+		if ok {
+			delete(x.waiters, pdu.RequestID)
+		}
+		x.mu.Unlock()
+
+		if !ok {
+			x.Log.Debug("No waiter for RequestID %d, dropping reply\n", pdu.RequestID)
+			continue
+		}
+		ch <- pdu
+	}
+}
+
+// failAllWaiters unblocks every outstanding caller once the socket itself
+// has died, so nobody hangs until their timeout fires.
+func (x *Conn) failAllWaiters(err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for id, ch := range x.waiters {
+		close(ch)
+		delete(x.waiters, id)
+	}
+}
+
+// nextRequestID allocates a process-wide-unique-per-Conn monotonic
+// RequestID for a new outstanding request.
+func (x *Conn) nextRequestID() int32 {
+	return atomic.AddInt32(&x.requestID, 1)
+}
+
+// register records that the caller is now waiting for a reply to
+// requestID, returning the channel its reply (or a nil on connection
+// failure) will arrive on.
+func (x *Conn) register(requestID int32) chan *SnmpPacket {
+	ch := make(chan *SnmpPacket, 1)
+	x.mu.Lock()
+	x.waiters[requestID] = ch
+	x.mu.Unlock()
+	return ch
+}
+
+// deregister removes a waiter that gave up (timeout, cancellation)
+// before a reply arrived.
+func (x *Conn) deregister(requestID int32) {
+	x.mu.Lock()
+	delete(x.waiters, requestID)
+	x.mu.Unlock()
+}
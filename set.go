@@ -0,0 +1,143 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SnmpError is the typed form of a PDU's errorStatus/errorIndex, returned
+// by Set (and SetContext) when the agent rejects a SetRequest.
+type SnmpError struct {
+	Status SnmpErrorStatus
+	Index  int
+}
+
+func (e *SnmpError) Error() string {
+	return fmt.Sprintf("SNMP error %s at varbind index %d", e.Status, e.Index)
+}
+
+// SnmpErrorStatus is the errorStatus field of an SNMP response PDU, as
+// defined in RFC 3416 section 3.
+type SnmpErrorStatus int
+
+const (
+	NoError             SnmpErrorStatus = 0
+	TooBig              SnmpErrorStatus = 1
+	NoSuchName          SnmpErrorStatus = 2
+	BadValue            SnmpErrorStatus = 3
+	ReadOnly            SnmpErrorStatus = 4
+	GenErr              SnmpErrorStatus = 5
+	NoAccess            SnmpErrorStatus = 6
+	WrongType           SnmpErrorStatus = 7
+	WrongLength         SnmpErrorStatus = 8
+	WrongEncoding       SnmpErrorStatus = 9
+	WrongValue          SnmpErrorStatus = 10
+	NoCreation          SnmpErrorStatus = 11
+	InconsistentValue   SnmpErrorStatus = 12
+	ResourceUnavailable SnmpErrorStatus = 13
+	CommitFailed        SnmpErrorStatus = 14
+	UndoFailed          SnmpErrorStatus = 15
+	AuthorizationError  SnmpErrorStatus = 16
+	NotWritable         SnmpErrorStatus = 17
+	InconsistentName    SnmpErrorStatus = 18
+)
+
+var errorStatusText = map[SnmpErrorStatus]string{
+	NoError:             "noError",
+	TooBig:              "tooBig",
+	NoSuchName:          "noSuchName",
+	BadValue:            "badValue",
+	ReadOnly:            "readOnly",
+	GenErr:              "genErr",
+	NoAccess:            "noAccess",
+	WrongType:           "wrongType",
+	WrongLength:         "wrongLength",
+	WrongEncoding:       "wrongEncoding",
+	WrongValue:          "wrongValue",
+	NoCreation:          "noCreation",
+	InconsistentValue:   "inconsistentValue",
+	ResourceUnavailable: "resourceUnavailable",
+	CommitFailed:        "commitFailed",
+	UndoFailed:          "undoFailed",
+	AuthorizationError:  "authorizationError",
+	NotWritable:         "notWritable",
+	InconsistentName:    "inconsistentName",
+}
+
+func (s SnmpErrorStatus) String() string {
+	if text, ok := errorStatusText[s]; ok {
+		return text
+	}
+	return fmt.Sprintf("errorStatus(%d)", int(s))
+}
+
+// NewPDU builds an SnmpPDU for oid from a native Go value, encoding it to
+// the ASN.1 tag Set expects instead of requiring callers to hand-build a
+// typed SnmpPDU themselves. Supported value types: int32 (Integer),
+// uint32 (Gauge32), uint64 (Counter64), net.IP (IpAddress), time.Duration
+// (TimeTicks), []byte (OctetString), string (Oid).
+func NewPDU(oid string, value interface{}) (SnmpPDU, error) {
+	switch v := value.(type) {
+	case int32:
+		return SnmpPDU{Name: oid, Type: Integer, Value: v}, nil
+	case uint32:
+		return SnmpPDU{Name: oid, Type: Gauge32, Value: v}, nil
+	case uint64:
+		return SnmpPDU{Name: oid, Type: Counter64, Value: v}, nil
+	case net.IP:
+		return SnmpPDU{Name: oid, Type: IpAddress, Value: v.String()}, nil
+	case time.Duration:
+		return SnmpPDU{Name: oid, Type: TimeTicks, Value: uint32(v / (10 * time.Millisecond))}, nil
+	case []byte:
+		return SnmpPDU{Name: oid, Type: OctetString, Value: v}, nil
+	case string:
+		return SnmpPDU{Name: oid, Type: Oid, Value: v}, nil
+	default:
+		return SnmpPDU{}, fmt.Errorf("NewPDU: unsupported value type %T for %s\n", value, oid)
+	}
+}
+
+// Set sends an SNMP SET request to the target, writing every pdu in a
+// single SetRequest-PDU. If the agent rejects the request, the returned
+// error is a *SnmpError identifying which varbind failed and why.
+func (x *Conn) Set(pdus ...SnmpPDU) (*SnmpPacket, error) {
+	return x.SetContext(context.Background(), pdus...)
+}
+
+// SetContext is the context-aware form of Set.
+func (x *Conn) SetContext(ctx context.Context, pdus ...SnmpPDU) (resp *SnmpPacket, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if len(pdus) == 0 {
+		return nil, fmt.Errorf("No varbinds given to Set\n")
+	}
+
+	packet := new(SnmpPacket)
+	packet.Community = x.Community
+	packet.Error = 0
+	packet.ErrorIndex = 0
+	packet.RequestType = SetRequest
+	packet.Version = x.Version
+	packet.Variables = pdus
+
+	resp, err = x.sendPacketContext(ctx, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != 0 {
+		return resp, &SnmpError{Status: SnmpErrorStatus(resp.Error), Index: resp.ErrorIndex}
+	}
+
+	return resp, nil
+}
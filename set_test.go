@@ -0,0 +1,79 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewPDU(t *testing.T) {
+	const oid = "1.3.6.1.2.1.1.1.0"
+
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{"int32", int32(42)},
+		{"uint32", uint32(42)},
+		{"uint64", uint64(42)},
+		{"net.IP", net.ParseIP("192.0.2.1")},
+		{"time.Duration", 2500 * time.Millisecond},
+		{"[]byte", []byte("hello")},
+		{"string", "1.3.6.1.2.1.1.1.0"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pdu, err := NewPDU(oid, c.value)
+			if err != nil {
+				t.Fatalf("NewPDU(%q, %v): %s", oid, c.value, err)
+			}
+			if pdu.Name != oid {
+				t.Errorf("Name = %q, want %q", pdu.Name, oid)
+			}
+
+			switch v := c.value.(type) {
+			case int32:
+				if pdu.Type != Integer || pdu.Value != v {
+					t.Errorf("got (%v, %v), want (Integer, %v)", pdu.Type, pdu.Value, v)
+				}
+			case uint32:
+				if pdu.Type != Gauge32 || pdu.Value != v {
+					t.Errorf("got (%v, %v), want (Gauge32, %v)", pdu.Type, pdu.Value, v)
+				}
+			case uint64:
+				if pdu.Type != Counter64 || pdu.Value != v {
+					t.Errorf("got (%v, %v), want (Counter64, %v)", pdu.Type, pdu.Value, v)
+				}
+			case net.IP:
+				if pdu.Type != IpAddress || pdu.Value != v.String() {
+					t.Errorf("got (%v, %v), want (IpAddress, %v)", pdu.Type, pdu.Value, v.String())
+				}
+			case time.Duration:
+				want := uint32(v / (10 * time.Millisecond))
+				if pdu.Type != TimeTicks || pdu.Value != want {
+					t.Errorf("got (%v, %v), want (TimeTicks, %v)", pdu.Type, pdu.Value, want)
+				}
+			case []byte:
+				got, ok := pdu.Value.([]byte)
+				if pdu.Type != OctetString || !ok || string(got) != string(v) {
+					t.Errorf("got (%v, %v), want (OctetString, %v)", pdu.Type, pdu.Value, v)
+				}
+			case string:
+				if pdu.Type != Oid || pdu.Value != v {
+					t.Errorf("got (%v, %v), want (Oid, %v)", pdu.Type, pdu.Value, v)
+				}
+			}
+		})
+	}
+}
+
+func TestNewPDUUnsupportedType(t *testing.T) {
+	if _, err := NewPDU("1.3.6.1.2.1.1.1.0", 3.14); err == nil {
+		t.Fatal("NewPDU with an unsupported value type should return an error")
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	l "github.com/alouca/gologger"
+)
+
+// TrapEvent bundles a decoded trap/inform with the address it arrived
+// from, for callers who prefer reading a channel over implementing
+// TrapHandler.
+type TrapEvent struct {
+	Packet *SnmpPacket
+	From   net.Addr
+}
+
+// TrapHandler receives every trap or inform that passes the listener's
+// filters.
+type TrapHandler interface {
+	OnTrap(packet *SnmpPacket, from net.Addr)
+}
+
+// TrapListener is the server-side counterpart to Connect: it listens for
+// v1 Trap-PDUs, v2c/v3 SNMPv2-Trap-PDUs and InformRequest-PDUs, and
+// dispatches each to the registered handlers and/or the Traps() channel.
+// InformRequest-PDUs are automatically acknowledged with a Response-PDU
+// echoing the sender's varbinds and RequestID, as required by RFC 3416.
+type TrapListener struct {
+	Log *l.Logger
+
+	// USM, when set at authNoPriv, authenticates every incoming datagram
+	// with its key before decoding it. At authPriv every datagram is
+	// discarded, since unwrap does not decrypt. When USM is nil or at
+	// noAuthNoPriv, datagrams are decoded without any USM processing.
+	USM *USMSecurityParameters
+
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	handlers []TrapHandler
+	filters  []string
+	events   chan *TrapEvent
+	done     chan struct{}
+	closed   bool
+}
+
+// NewTrapListener creates a TrapListener ready to have handlers and
+// filters registered before ListenTrap is called.
+func NewTrapListener() *TrapListener {
+	return &TrapListener{
+		Log:    l.CreateLogger(false, false),
+		events: make(chan *TrapEvent, 64),
+		done:   make(chan struct{}),
+	}
+}
+
+// AddHandler registers h to receive every trap/inform that passes the
+// configured filters.
+func (t *TrapListener) AddHandler(h TrapHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handlers = append(t.handlers, h)
+}
+
+// AddFilter restricts delivery to traps whose snmpTrapOID.0 value starts
+// with oidPrefix. With no filters registered, every trap is delivered.
+// Traps that carry no snmpTrapOID.0 varbind (such as v1 Trap-PDUs) are
+// delivered regardless of the filters.
+func (t *TrapListener) AddFilter(oidPrefix string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filters = append(t.filters, oidPrefix)
+}
+
+// Traps returns a channel of the traps/informs that pass the configured
+// filters, analogous to StreamWalk for walks. The channel buffers 64
+// events; an event that arrives while the buffer is full is dropped from
+// the channel (registered handlers still receive it). The channel is
+// closed when Close is called.
+func (t *TrapListener) Traps() <-chan *TrapEvent {
+	return t.events
+}
+
+// ListenTrap opens a UDP socket on addr (host:port, defaulting to
+// DefaultTrapPort if no port is given) and starts dispatching traps in a
+// background goroutine. It returns once the socket is bound.
+func (t *TrapListener) ListenTrap(addr string) error {
+	if !strings.Contains(addr, ":") {
+		addr = fmt.Sprintf("%s:%d", addr, DefaultTrapPort)
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Error resolving trap listen address: %s\n", err.Error())
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("Error binding trap listener: %s\n", err.Error())
+	}
+	t.conn = conn
+
+	go t.listen()
+
+	return nil
+}
+
+// DefaultTrapPort is the default port traps and informs are received on.
+var DefaultTrapPort = 162
+
+// Close stops accepting traps and closes the underlying socket. It is
+// safe to call more than once. If ListenTrap was never called (or failed
+// to bind), Close closes the Traps() channel itself, as there is no
+// socket to close. Otherwise the Traps() channel is closed by the listen
+// goroutine once it has returned, not here, so a send from dispatch can
+// never race a close of that channel.
+func (t *TrapListener) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	started := t.conn != nil
+	t.mu.Unlock()
+
+	close(t.done)
+	if !started {
+		close(t.events)
+		return nil
+	}
+	return t.conn.Close()
+}
+
+func (t *TrapListener) listen() {
+	defer close(t.events)
+	for {
+		// A fresh buffer every read: buf[:n] is retained by any TrapEvent
+		// queued off of it, which may still be read after the next
+		// datagram arrives (the same aliasing bug chunk0-2 fixed in
+		// readLoop).
+		buf := make([]byte, 8192, 8192)
+		n, from, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-t.done:
+				return
+			default:
+				t.Log.Debug("Error reading trap datagram: %s\n", err.Error())
+				continue
+			}
+		}
+
+		t.handleDatagram(buf[:n], from)
+	}
+}
+
+// handleDatagram decodes and dispatches a single trap/inform datagram.
+// It recovers from any panic in the USM decrypt path so a malformed or
+// unexpected datagram drops that one trap instead of killing the
+// listener goroutine.
+func (t *TrapListener) handleDatagram(data []byte, from net.Addr) {
+	defer func() {
+		if e := recover(); e != nil {
+			t.Log.Debug("Recovered from panic handling trap from %s: %v\n", from, e)
+		}
+	}()
+
+	var err error
+	if t.USM != nil && t.USM.SecurityLevel != NoAuthNoPriv {
+		t.USM.mu.Lock()
+		discovered := t.USM.discovered
+		t.USM.mu.Unlock()
+		if !discovered {
+			// A trap sender is its own authoritative engine and never
+			// goes through discovery; callers must seed the engine ID
+			// with USM.Localize before ListenTrap.
+			t.Log.Debug("Discarding v3 trap from %s: USM has no authoritative engine ID (call USM.Localize first)\n", from)
+			return
+		}
+		data, err = t.USM.unwrap(data)
+		if err != nil {
+			t.Log.Debug("Discarding trap that failed SNMPv3 authentication from %s: %s\n", from, err.Error())
+			return
+		}
+	}
+
+	packet, err := Unmarshal(data)
+	if err != nil {
+		t.Log.Debug("Discarding unparseable trap from %s: %s\n", from, err.Error())
+		return
+	}
+
+	if packet.Version == Version3 && t.USM != nil {
+		packet.SecurityParameters = t.USM
+	}
+
+	if packet.RequestType == InformRequest {
+		t.acknowledge(packet, from)
+	}
+
+	if !t.passesFilters(packet) {
+		return
+	}
+
+	t.dispatch(packet, from)
+}
+
+// acknowledge replies to an InformRequest-PDU with a Response-PDU that
+// echoes the sender's varbinds and RequestID, per RFC 3416 section 4.2.6.
+func (t *TrapListener) acknowledge(packet *SnmpPacket, from net.Addr) {
+	reply := new(SnmpPacket)
+	reply.Community = packet.Community
+	reply.Version = packet.Version
+	reply.RequestType = GetResponse
+	reply.RequestID = packet.RequestID
+	reply.Variables = packet.Variables
+	reply.SecurityParameters = packet.SecurityParameters
+
+	fBuf, err := reply.marshal()
+	if err != nil {
+		t.Log.Debug("Error marshalling inform response: %s\n", err.Error())
+		return
+	}
+	if _, err := t.conn.WriteTo(fBuf, from); err != nil {
+		t.Log.Debug("Error acknowledging inform from %s: %s\n", from, err.Error())
+	}
+}
+
+// snmpTrapOIDVarbind is the well-known OID (RFC 3584 section 3.1) whose
+// value, not name, carries the actual trap OID in a v2c/v3 trap's
+// variable-bindings.
+const snmpTrapOIDVarbind = "1.3.6.1.6.3.1.1.4.1.0"
+
+// trapOID returns the OID a v2c/v3 trap is reporting, i.e. the value of
+// its snmpTrapOID.0 varbind, or "" if packet has none (as is always the
+// case for a v1 Trap-PDU, which carries no such varbind).
+func trapOID(packet *SnmpPacket) string {
+	for _, v := range packet.Variables {
+		if v.Name == snmpTrapOIDVarbind {
+			if oid, ok := v.Value.(string); ok {
+				return oid
+			}
+		}
+	}
+	return ""
+}
+
+// passesFilters reports whether packet's snmpTrapOID value matches one of
+// the registered prefixes. With no filters registered, everything passes.
+// v1 Trap-PDUs carry no snmpTrapOID varbind to filter on, so they always
+// pass once any filter is registered, rather than being silently dropped.
+func (t *TrapListener) passesFilters(packet *SnmpPacket) bool {
+	t.mu.Lock()
+	filters := t.filters
+	t.mu.Unlock()
+
+	if len(filters) == 0 {
+		return true
+	}
+
+	oid := trapOID(packet)
+	if oid == "" {
+		return true
+	}
+	for _, prefix := range filters {
+		if strings.HasPrefix(oid, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TrapListener) dispatch(packet *SnmpPacket, from net.Addr) {
+	t.mu.Lock()
+	handlers := t.handlers
+	t.mu.Unlock()
+
+	for _, h := range handlers {
+		h.OnTrap(packet, from)
+	}
+
+	select {
+	case t.events <- &TrapEvent{Packet: packet, From: from}:
+	default:
+		t.Log.Debug("Traps() channel full, dropping trap from %s\n", from)
+	}
+}
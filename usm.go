@@ -0,0 +1,535 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/alouca/gologger"
+)
+
+// Version3 identifies SNMPv3 PDU encoding and the User-based Security
+// Model (USM) described in RFC 3414.
+const Version3 SnmpVersion = 3
+
+// SecurityLevel gates which of the USM fields a request is required to
+// carry: authentication, and/or privacy (encryption) of the scoped PDU.
+type SecurityLevel int
+
+const (
+	NoAuthNoPriv SecurityLevel = iota
+	AuthNoPriv
+	AuthPriv
+)
+
+// SnmpV3AuthProtocol identifies the HMAC used to authenticate USM messages.
+type SnmpV3AuthProtocol int
+
+const (
+	NoAuth SnmpV3AuthProtocol = iota
+	MD5
+	SHA
+	SHA224
+	SHA256
+	SHA384
+	SHA512
+)
+
+// SnmpV3PrivProtocol identifies the cipher used to encrypt the scoped PDU.
+type SnmpV3PrivProtocol int
+
+const (
+	NoPriv SnmpV3PrivProtocol = iota
+	DES
+	AES128
+	AES192
+	AES256
+)
+
+// USMSecurityParameters holds the SNMPv3 User-based Security Model
+// configuration for a Conn, along with the engine state that sendPacket
+// discovers and maintains on its behalf. It is safe for concurrent use.
+type USMSecurityParameters struct {
+	UserName        string
+	AuthProtocol    SnmpV3AuthProtocol
+	AuthPassphrase  string
+	PrivProtocol    SnmpV3PrivProtocol
+	PrivPassphrase  string
+	ContextName     string
+	ContextEngineID string
+	SecurityLevel   SecurityLevel
+
+	mu                    sync.Mutex
+	discovered            bool
+	authoritativeEngineID string
+	engineBoots           int32
+	engineTime            int32
+	localClockOffset      time.Duration
+	localizedAuthKey      []byte
+	localizedPrivKey      []byte
+	salt                  uint32
+}
+
+// Localize sets the authoritative engine ID this USMSecurityParameters
+// should localize its auth/priv keys against, and derives those keys.
+// ConnectV3's discovery exchange sets the engine ID and derives the keys
+// the same way without calling Localize; TrapListener users configuring USM ahead of time should call it
+// directly with the trap sender's engine ID, since a trap sender is its
+// own authoritative engine and never goes through discovery.
+func (u *USMSecurityParameters) Localize(engineID string) error {
+	u.mu.Lock()
+	u.authoritativeEngineID = engineID
+	u.discovered = true
+	u.mu.Unlock()
+	return u.localizeKeys()
+}
+
+// ConnectV3 creates a new SNMPv3 Client. Target is the IP address and
+// timeout is measured in seconds. usm describes the user and the
+// authentication/privacy protocols to use for it; usm.SecurityLevel gates
+// which of AuthPassphrase and PrivPassphrase are required. ConnectV3
+// performs the engine discovery exchange before returning, so that the
+// first real request already has a usable EngineBoots/EngineTime.
+func ConnectV3(target string, timeout int64, usm *USMSecurityParameters) (*Conn, error) {
+	if usm == nil {
+		return nil, fmt.Errorf("USMSecurityParameters is required for SNMPv3\n")
+	}
+	if usm.UserName == "" {
+		return nil, fmt.Errorf("UserName is required for SNMPv3\n")
+	}
+	if usm.SecurityLevel >= AuthNoPriv && usm.AuthProtocol == NoAuth {
+		return nil, fmt.Errorf("AuthProtocol is required at security level authNoPriv/authPriv\n")
+	}
+	if usm.SecurityLevel >= AuthNoPriv && usm.AuthPassphrase == "" {
+		return nil, fmt.Errorf("AuthPassphrase is required at security level authNoPriv/authPriv\n")
+	}
+	if usm.SecurityLevel == AuthPriv && usm.PrivPassphrase == "" {
+		return nil, fmt.Errorf("PrivPassphrase is required at security level authPriv\n")
+	}
+
+	if !strings.Contains(target, ":") {
+		target = fmt.Sprintf("%s:%d", target, DefaultPort)
+	}
+
+	conn, err := net.DialTimeout("udp", target, time.Duration(timeout)*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Error establishing connection to host: %s\n", err.Error())
+	}
+
+	s := &Conn{
+		Target:     target,
+		Version:    Version3,
+		Timeout:    time.Duration(timeout) * time.Second,
+		conn:       conn,
+		Log:        l.CreateLogger(false, false),
+		usm:        usm,
+		Retries:    DefaultRetries,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+
+	s.startReader()
+
+	if err := s.discoverEngine(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// discoverEngine learns the authoritative engine's ID, boot count and
+// time by sending an unauthenticated GET with an empty UserName, per RFC
+// 3414 section 4. Once the engine ID is known it localizes the auth/priv
+// keys for this user against it.
+func (x *Conn) discoverEngine() error {
+	probe := new(SnmpPacket)
+	probe.RequestType = GetRequest
+	probe.Version = Version3
+	probe.Variables = []SnmpPDU{SnmpPDU{Name: "", Type: Null}}
+	probe.SecurityParameters = &USMSecurityParameters{}
+
+	resp, err := x.transact(context.Background(), probe)
+	if err != nil {
+		return fmt.Errorf("SNMPv3 engine discovery failed: %s\n", err.Error())
+	}
+	if resp.SecurityParameters == nil || resp.SecurityParameters.authoritativeEngineID == "" {
+		return fmt.Errorf("SNMPv3 engine discovery did not return an authoritative engine ID\n")
+	}
+
+	x.usm.mu.Lock()
+	x.usm.authoritativeEngineID = resp.SecurityParameters.authoritativeEngineID
+	x.usm.engineBoots = resp.SecurityParameters.engineBoots
+	x.usm.engineTime = resp.SecurityParameters.engineTime
+	x.usm.localClockOffset = 0
+	x.usm.discovered = true
+	x.usm.mu.Unlock()
+
+	return x.usm.localizeKeys()
+}
+
+// newHash returns a fresh hash.Hash for the given auth protocol.
+func (p SnmpV3AuthProtocol) newHash() (hash.Hash, error) {
+	switch p {
+	case MD5:
+		return md5.New(), nil
+	case SHA:
+		return sha1.New(), nil
+	case SHA224:
+		return sha256.New224(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case SHA384:
+		return sha512.New384(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported auth protocol %v\n", p)
+	}
+}
+
+// digestLen is the number of bytes appended to msgAuthenticationParameters,
+// i.e. the truncated HMAC length for this protocol (RFC 3414 / RFC 7860).
+func (p SnmpV3AuthProtocol) digestLen() int {
+	switch p {
+	case MD5, SHA:
+		return 12
+	case SHA224:
+		return 16
+	case SHA256:
+		return 24
+	case SHA384:
+		return 32
+	case SHA512:
+		return 48
+	default:
+		return 0
+	}
+}
+
+// passwordToKey implements the RFC 3414 appendix A.2 Ku derivation: the
+// passphrase is repeated to fill 1MB and digested.
+func passwordToKey(proto SnmpV3AuthProtocol, passphrase string) ([]byte, error) {
+	h, err := proto.newHash()
+	if err != nil {
+		return nil, err
+	}
+
+	const megabyte = 1048576
+	password := []byte(passphrase)
+	buf := make([]byte, 64)
+	written := 0
+	for written < megabyte {
+		for i := 0; i < 64; i++ {
+			buf[i] = password[(written+i)%len(password)]
+		}
+		h.Write(buf)
+		written += 64
+	}
+	return h.Sum(nil), nil
+}
+
+// localizeKey implements the RFC 3414 appendix A.2 localization step:
+// KuL = H(Ku || engineID || Ku).
+func localizeKey(proto SnmpV3AuthProtocol, ku []byte, engineID []byte) ([]byte, error) {
+	h, err := proto.newHash()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil), nil
+}
+
+// localizeKeys derives localizedAuthKey and localizedPrivKey for the
+// current authoritativeEngineID. Must be called with the engine ID
+// already populated (i.e. after discovery).
+func (u *USMSecurityParameters) localizeKeys() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	engineID := []byte(u.authoritativeEngineID)
+
+	if u.SecurityLevel >= AuthNoPriv {
+		ku, err := passwordToKey(u.AuthProtocol, u.AuthPassphrase)
+		if err != nil {
+			return err
+		}
+		kul, err := localizeKey(u.AuthProtocol, ku, engineID)
+		if err != nil {
+			return err
+		}
+		u.localizedAuthKey = kul
+	}
+
+	if u.SecurityLevel == AuthPriv {
+		ku, err := passwordToKey(u.AuthProtocol, u.PrivPassphrase)
+		if err != nil {
+			return err
+		}
+		kul, err := localizeKey(u.AuthProtocol, ku, engineID)
+		if err != nil {
+			return err
+		}
+		u.localizedPrivKey = extendKey(u.AuthProtocol, ku, kul, u.PrivProtocol.privKeyLen())
+	}
+
+	return nil
+}
+
+// extendKey implements the Blumenthal AES-USM key extension
+// (draft-blumenthal-aes-usm-04 section 3.1.2.1): MD5/SHA1 localization
+// only yields 16/20 bytes, which isn't enough key material for
+// AES192/AES256, so additional bytes are derived by repeatedly hashing
+// Ku with the previous output and appending until length is reached.
+func extendKey(proto SnmpV3AuthProtocol, ku, localized []byte, length int) []byte {
+	key := append([]byte{}, localized...)
+	last := localized
+	for len(key) < length {
+		h, err := proto.newHash()
+		if err != nil {
+			break
+		}
+		h.Write(ku)
+		h.Write(last)
+		last = h.Sum(nil)
+		key = append(key, last...)
+	}
+	if len(key) < length {
+		return key
+	}
+	return key[:length]
+}
+
+// sign computes the truncated HMAC digest that goes into
+// msgAuthenticationParameters. msg must have that field already zeroed.
+func (u *USMSecurityParameters) sign(msg []byte) ([]byte, error) {
+	u.mu.Lock()
+	key := u.localizedAuthKey
+	proto := u.AuthProtocol
+	u.mu.Unlock()
+
+	// hmac.New calls the constructor twice (inner and outer hash), so it
+	// must get a fresh hash.Hash each time, not one shared instance.
+	newHash := func() hash.Hash {
+		h, _ := proto.newHash()
+		return h
+	}
+	if newHash() == nil {
+		return nil, fmt.Errorf("unsupported auth protocol %v\n", proto)
+	}
+	mac := hmac.New(newHash, key)
+	mac.Write(msg)
+	return mac.Sum(nil)[:proto.digestLen()], nil
+}
+
+// privKeyLen is the cipher key length in bytes for a priv protocol.
+func (p SnmpV3PrivProtocol) privKeyLen() int {
+	switch p {
+	case DES:
+		return 8
+	case AES128:
+		return 16
+	case AES192:
+		return 24
+	case AES256:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// encrypt encrypts a scoped PDU with the localized priv key, returning
+// the ciphertext and the msgPrivacyParameters salt to send alongside it.
+func (u *USMSecurityParameters) encrypt(scopedPDU []byte) (ciphertext, salt []byte, err error) {
+	u.mu.Lock()
+	key := u.localizedPrivKey[:u.PrivProtocol.privKeyLen()]
+	boots := u.engineBoots
+	engTime := u.engineTime
+	u.salt++
+	localSalt := u.salt
+	proto := u.PrivProtocol
+	u.mu.Unlock()
+
+	switch proto {
+	case DES:
+		block, err := des.NewCipher(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		salt = make([]byte, 8)
+		binary.BigEndian.PutUint32(salt[0:4], uint32(boots))
+		binary.BigEndian.PutUint32(salt[4:8], localSalt)
+		iv := xorBytes(u.localizedPrivKey[8:16], salt)
+		padded := padTo(scopedPDU, des.BlockSize)
+		out := make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+		return out, salt, nil
+	case AES128, AES192, AES256:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		salt = make([]byte, 8)
+		binary.BigEndian.PutUint32(salt[0:4], uint32(time.Now().UnixNano()))
+		binary.BigEndian.PutUint32(salt[4:8], localSalt)
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint32(iv[0:4], uint32(boots))
+		binary.BigEndian.PutUint32(iv[4:8], uint32(engTime))
+		copy(iv[8:16], salt)
+		out := make([]byte, len(scopedPDU))
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(out, scopedPDU)
+		return out, salt, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported priv protocol %v\n", proto)
+	}
+}
+
+// decrypt reverses encrypt given the msgPrivacyParameters salt that came
+// back with the response.
+func (u *USMSecurityParameters) decrypt(ciphertext, salt []byte, boots, engTime int32) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("decrypt: msgPrivacyParameters must be 8 bytes, got %d\n", len(salt))
+	}
+
+	u.mu.Lock()
+	key := u.localizedPrivKey[:u.PrivProtocol.privKeyLen()]
+	proto := u.PrivProtocol
+	u.mu.Unlock()
+
+	switch proto {
+	case DES:
+		block, err := des.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		iv := xorBytes(u.localizedPrivKey[8:16], salt)
+		out := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, ciphertext)
+		return out, nil
+	case AES128, AES192, AES256:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint32(iv[0:4], uint32(boots))
+		binary.BigEndian.PutUint32(iv[4:8], uint32(engTime))
+		copy(iv[8:16], salt)
+		out := make([]byte, len(ciphertext))
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(out, ciphertext)
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported priv protocol %v\n", proto)
+	}
+}
+
+// wrap applies this user's configured SecurityLevel to an already
+// marshalled v3 message before it goes on the wire: AuthPriv encrypts the
+// body and then signs the result; AuthNoPriv only signs.
+//
+// This does not yet produce RFC 3414 wire framing: a standards-compliant
+// sender zeroes msgAuthenticationParameters in place inside
+// msgSecurityParameters and encrypts only the scopedPDU, but wrap only
+// ever sees the fully marshalled message as an opaque byte slice (ASN.1
+// encoding is owned by marshal/Unmarshal, which this package does not
+// implement), so it can only encrypt/sign the whole thing and append the
+// digest to the end. It will not interoperate with a standards-compliant
+// peer until that framing is implemented; it exists so sign/encrypt are
+// actually exercised rather than being dead code. Must only be called
+// once localizeKeys has run (i.e. after discovery/Localize).
+func (u *USMSecurityParameters) wrap(msg []byte) ([]byte, error) {
+	out := msg
+
+	if u.SecurityLevel == AuthPriv {
+		ciphertext, _, err := u.encrypt(out)
+		if err != nil {
+			return nil, err
+		}
+		out = ciphertext
+	}
+
+	if u.SecurityLevel >= AuthNoPriv {
+		digest, err := u.sign(out)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, digest...)
+	}
+
+	return out, nil
+}
+
+// unwrap reverses wrap's signing: it verifies and strips the trailing
+// HMAC digest, returning bytes ready for Unmarshal. It does not decrypt:
+// at AuthPriv it returns an error for every message.
+//
+// The real msgPrivacyParameters salt for an incoming message travels in
+// its own cleartext header, independently of anything this Conn sent;
+// this package has no ASN.1 header parser to read it out ahead of
+// Unmarshal. An earlier version of this method "solved" that by reusing
+// the salt from this USMSecurityParameters' own last outgoing wrap, but
+// that is wrong even for the request that produced it (a peer's salt is
+// its own, not a copy of ours) and actively unsafe once a Conn is shared
+// across concurrent requests (chunk0-2's multiplexer), since whichever
+// wrap ran last would clobber the salt every other in-flight decrypt
+// relied on. Until header parsing exists, decline to decrypt rather than
+// transform the body with a salt that cannot be correct.
+func (u *USMSecurityParameters) unwrap(msg []byte) ([]byte, error) {
+	out := msg
+
+	if u.SecurityLevel >= AuthNoPriv {
+		n := u.AuthProtocol.digestLen()
+		if len(out) < n {
+			return nil, fmt.Errorf("SNMPv3 message too short to carry an authentication digest\n")
+		}
+		body, digest := out[:len(out)-n], out[len(out)-n:]
+		expected, err := u.sign(body)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(digest, expected) {
+			return nil, fmt.Errorf("SNMPv3 authentication failed: HMAC mismatch\n")
+		}
+		out = body
+	}
+
+	if u.SecurityLevel == AuthPriv {
+		return nil, fmt.Errorf("SNMPv3 decrypt requires the inbound msgPrivacyParameters, which this package cannot yet parse out of the raw datagram\n")
+	}
+
+	return out, nil
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func padTo(b []byte, blockSize int) []byte {
+	pad := blockSize - len(b)%blockSize
+	if pad == blockSize {
+		return b
+	}
+	return append(append([]byte{}, b...), make([]byte, pad)...)
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 Andreas Louca. All rights reserved.
+// Use of this source code is goverend by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosnmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// RFC 3414 Appendix A.3 known-answer vectors: password "maplesyrup"
+// localized against snmpEngineID 00 00 00 00 00 00 00 00 00 00 00 02.
+var rfc3414EngineID = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+func TestPasswordToKey(t *testing.T) {
+	cases := []struct {
+		proto      SnmpV3AuthProtocol
+		passphrase string
+		wantHex    string
+	}{
+		{MD5, "maplesyrup", "9faf3283884e92834ebc9847d8edd963"},
+		{SHA, "maplesyrup", "9fb5cc0381497b3793528939ff788d5d79145211"},
+	}
+
+	for _, c := range cases {
+		got, err := passwordToKey(c.proto, c.passphrase)
+		if err != nil {
+			t.Fatalf("passwordToKey(%v, %q): %s", c.proto, c.passphrase, err)
+		}
+		want, err := hex.DecodeString(c.wantHex)
+		if err != nil {
+			t.Fatalf("bad test vector %q: %s", c.wantHex, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("passwordToKey(%v, %q) = %x, want %x", c.proto, c.passphrase, got, want)
+		}
+	}
+}
+
+func TestLocalizeKey(t *testing.T) {
+	cases := []struct {
+		proto   SnmpV3AuthProtocol
+		kuHex   string
+		wantHex string
+	}{
+		{MD5, "9faf3283884e92834ebc9847d8edd963", "526f5eed9fcce26f8964c2930787d82b"},
+		{SHA, "9fb5cc0381497b3793528939ff788d5d79145211", "6695febc9288e36282235fc7151f128497b38f3f"},
+	}
+
+	for _, c := range cases {
+		ku, err := hex.DecodeString(c.kuHex)
+		if err != nil {
+			t.Fatalf("bad test vector %q: %s", c.kuHex, err)
+		}
+		want, err := hex.DecodeString(c.wantHex)
+		if err != nil {
+			t.Fatalf("bad test vector %q: %s", c.wantHex, err)
+		}
+
+		got, err := localizeKey(c.proto, ku, rfc3414EngineID)
+		if err != nil {
+			t.Fatalf("localizeKey(%v, ...): %s", c.proto, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("localizeKey(%v, %x, %x) = %x, want %x", c.proto, ku, rfc3414EngineID, got, want)
+		}
+	}
+}
+
+func TestDigestLen(t *testing.T) {
+	cases := []struct {
+		proto SnmpV3AuthProtocol
+		want  int
+	}{
+		{NoAuth, 0},
+		{MD5, 12},
+		{SHA, 12},
+		{SHA224, 16},
+		{SHA256, 24},
+		{SHA384, 32},
+		{SHA512, 48},
+	}
+
+	for _, c := range cases {
+		if got := c.proto.digestLen(); got != c.want {
+			t.Errorf("%v.digestLen() = %d, want %d", c.proto, got, c.want)
+		}
+	}
+}
+
+func TestExtendKey(t *testing.T) {
+	ku := []byte("arbitrary master key material")
+	localized := []byte{0x01, 0x02, 0x03, 0x04}
+
+	// Extending to a length no longer than the localized key returns the
+	// localized key truncated to that length, with nothing derived.
+	if got := extendKey(MD5, ku, localized, 2); !bytes.Equal(got, localized[:2]) {
+		t.Errorf("extendKey to shorter length = %x, want %x", got, localized[:2])
+	}
+
+	// Extending past the localized key's length must preserve it as a
+	// prefix and pad out to exactly the requested length.
+	const want = 32
+	got := extendKey(MD5, ku, localized, want)
+	if len(got) != want {
+		t.Fatalf("extendKey length = %d, want %d", len(got), want)
+	}
+	if !bytes.Equal(got[:len(localized)], localized) {
+		t.Errorf("extendKey(...)[:%d] = %x, want %x (localized key as prefix)", len(localized), got[:len(localized)], localized)
+	}
+
+	// Deterministic: same inputs produce the same extended key every time.
+	again := extendKey(MD5, ku, localized, want)
+	if !bytes.Equal(got, again) {
+		t.Errorf("extendKey is not deterministic: %x != %x", got, again)
+	}
+}